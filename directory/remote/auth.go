@@ -0,0 +1,177 @@
+// Copyright 2016 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package remote
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+
+	"upspin.googlesource.com/upspin.git/upspin"
+)
+
+// protocolVersion identifies the wire format of LoginRPCArgs understood by
+// this client. Servers reject requests whose Version does not match.
+const protocolVersion = 1
+
+// authWindow bounds how far RequestTime may drift from the server's clock
+// before a login is rejected as stale, guarding against replay of an old,
+// otherwise-valid signature.
+const authWindow = 15 * time.Minute
+
+// tokenRenewSlack is how long before a session token expires the client
+// proactively renews it, so an in-flight call never races an expiring token.
+const tokenRenewSlack = time.Minute
+
+// LoginRPCArgs is sent as the Authenticate RPC request. The client signs
+// Version, RequestTime, UserName and ServerNetAddr with its factotum key so
+// the server can verify both the caller's identity and that the request was
+// made for this server, within this time window. This mirrors the
+// LoginRPCArgs/LoginRPCReply pattern used by minio's RPC login handshake.
+type LoginRPCArgs struct {
+	Version       uint16
+	RequestTime   time.Time
+	UserName      upspin.UserName
+	ServerNetAddr upspin.NetAddr
+	Signature     upspin.Signature
+}
+
+// LoginRPCReply is the Authenticate RPC response. Token is an opaque session
+// identifier that the client attaches, alongside ID, to each subsequent
+// Server_%d.* request whose type carries a Token field. The client renews
+// the token shortly before Expires passes by calling Authenticate again,
+// which runs the full signed handshake; LoginRPCArgs carries no Token, so
+// there is no lighter renewal path.
+type LoginRPCReply struct {
+	ID      int
+	Token   string
+	Expires time.Time
+}
+
+// session tracks the renewable token for one remote connection.
+type session struct {
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+func (s *session) valid() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.token != "" && time.Now().Before(s.expires.Add(-tokenRenewSlack))
+}
+
+func (s *session) set(token string, expires time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.token = token
+	s.expires = expires
+}
+
+func (s *session) get() (token string, expires time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.token, s.expires
+}
+
+// signedBytes returns the canonical byte string the client signs and the
+// server re-derives to verify a login: Version || RequestTime || UserName ||
+// ServerNetAddr, where each variable-length field is preceded by its length
+// as a fixed-width uint32. Without the length prefix, a malicious UserName
+// could absorb bytes that were meant to belong to ServerNetAddr (or vice
+// versa) while still hashing to the same signed string; the prefix fixes
+// each field's boundary so no such reinterpretation is possible.
+func signedBytes(version uint16, when time.Time, name upspin.UserName, addr upspin.NetAddr) []byte {
+	var buf []byte
+	buf = appendUint16(buf, version)
+	buf = appendUint64(buf, uint64(when.UnixNano()))
+	buf = appendLengthPrefixed(buf, []byte(name))
+	buf = appendLengthPrefixed(buf, []byte(addr))
+	return buf
+}
+
+func appendUint16(buf []byte, v uint16) []byte {
+	var tmp [2]byte
+	binary.BigEndian.PutUint16(tmp[:], v)
+	return append(buf, tmp[:]...)
+}
+
+func appendUint64(buf []byte, v uint64) []byte {
+	var tmp [8]byte
+	binary.BigEndian.PutUint64(tmp[:], v)
+	return append(buf, tmp[:]...)
+}
+
+func appendUint32(buf []byte, v uint32) []byte {
+	var tmp [4]byte
+	binary.BigEndian.PutUint32(tmp[:], v)
+	return append(buf, tmp[:]...)
+}
+
+// appendLengthPrefixed appends field preceded by its length as a uint32, so
+// that concatenating multiple fields this way is unambiguous: a reader (or
+// forger) cannot shift bytes across a field boundary without changing the
+// length prefix and thus the signed bytes.
+func appendLengthPrefixed(buf, field []byte) []byte {
+	buf = appendUint32(buf, uint32(len(field)))
+	return append(buf, field...)
+}
+
+// marshalSignature encodes an upspin.Signature for transports, like gRPC's
+// LoginRequest, that carry the signature as an opaque byte blob rather than
+// a gob-encoded Go value.
+func marshalSignature(sig upspin.Signature) []byte {
+	return []byte(fmt.Sprintf("%x:%x", sig.R, sig.S))
+}
+
+// Authenticate performs the cryptographic challenge-response handshake with
+// the remote server: it signs a fresh LoginRPCArgs with the context's
+// factotum key and, on success, remembers the returned session token so
+// later calls need not re-sign.
+func (r *remote) Authenticate(context *upspin.Context) (int, error) {
+	// Sign the bare host:port, not r.endpoint.NetAddr as stored (which
+	// keeps its scheme prefix, e.g. "https://host:port", so redial can
+	// still tell which TransportDialer to use). grpcRemote.authenticate
+	// signs stripScheme(endpoint).NetAddr too, since dialGRPC is only ever
+	// handed an already-stripped endpoint; stripping here as well means
+	// both transports sign identical bytes for the same logical server
+	// regardless of which one handled the call.
+	addr := stripScheme(r.endpoint).NetAddr
+	args := &LoginRPCArgs{
+		Version:       protocolVersion,
+		RequestTime:   time.Now(),
+		UserName:      context.UserName,
+		ServerNetAddr: addr,
+	}
+	sig, err := context.Factotum.Sign(signedBytes(args.Version, args.RequestTime, args.UserName, args.ServerNetAddr))
+	if err != nil {
+		return 0, fmt.Errorf("remote: signing login request: %v", err)
+	}
+	args.Signature = sig
+
+	var reply LoginRPCReply
+	if err := r.rpcClient.Call("Server.Authenticate", args, &reply); err != nil {
+		return 0, err
+	}
+	r.session.set(reply.Token, reply.Expires)
+	return reply.ID, nil
+}
+
+// reauthenticate renews the session token if it is missing or close to
+// expiry, re-running the full signed handshake. It is cheap to call on
+// every r.call: in the common case the cached token is still valid and no
+// RPC is made.
+func (r *remote) reauthenticate(context *upspin.Context) error {
+	if r.session.valid() {
+		return nil
+	}
+	id, err := r.Authenticate(context)
+	if err != nil {
+		return err
+	}
+	r.id = id
+	return nil
+}
@@ -0,0 +1,59 @@
+// Copyright 2016 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package remote
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"upspin.googlesource.com/upspin.git/upspin"
+)
+
+func TestSignedBytesBoundaryUnambiguous(t *testing.T) {
+	when := time.Unix(0, 12345)
+
+	// Shifting a byte from UserName to ServerNetAddr (or vice versa) must
+	// change the signed bytes, even though the plain concatenation of the
+	// two fields is identical in both cases.
+	a := signedBytes(protocolVersion, when, upspin.UserName("ab"), upspin.NetAddr("c"))
+	b := signedBytes(protocolVersion, when, upspin.UserName("a"), upspin.NetAddr("bc"))
+	if bytes.Equal(a, b) {
+		t.Fatalf("signedBytes(%q,%q) == signedBytes(%q,%q); fields are not unambiguously delimited", "ab", "c", "a", "bc")
+	}
+}
+
+func TestSignedBytesDeterministic(t *testing.T) {
+	when := time.Unix(0, 12345)
+	a := signedBytes(protocolVersion, when, upspin.UserName("user@example.com"), upspin.NetAddr("example.com:443"))
+	b := signedBytes(protocolVersion, when, upspin.UserName("user@example.com"), upspin.NetAddr("example.com:443"))
+	if !bytes.Equal(a, b) {
+		t.Fatalf("signedBytes is not deterministic for identical inputs")
+	}
+}
+
+func TestSessionValid(t *testing.T) {
+	var s session
+	if s.valid() {
+		t.Fatal("zero-value session reported valid")
+	}
+
+	s.set("tok", time.Now().Add(time.Hour))
+	if !s.valid() {
+		t.Fatal("session with a far-future expiry reported invalid")
+	}
+
+	// Within tokenRenewSlack of expiring, the session should be treated
+	// as no longer valid so callers proactively reauthenticate.
+	s.set("tok", time.Now().Add(tokenRenewSlack/2))
+	if s.valid() {
+		t.Fatal("session within tokenRenewSlack of expiry reported valid")
+	}
+
+	s.set("", time.Time{})
+	if s.valid() {
+		t.Fatal("session with empty token reported valid")
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright 2016 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package remote
+
+import (
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/connectivity"
+
+	"upspin.googlesource.com/upspin.git/upspin"
+)
+
+var grpcPingerOnce sync.Once
+
+// startGRPCPinger launches the background health checker for grpcConnections
+// exactly once per process, the gRPC-transport counterpart to pool.go's
+// startPinger. It has no RPC of its own to make: grpc.ClientConn already
+// tracks its transport's connectivity state, so each tick just samples
+// GetState() instead of issuing a Ping the way pingOne does for a net/rpc
+// client.
+func startGRPCPinger() {
+	grpcPingerOnce.Do(func() {
+		go func() {
+			for {
+				time.Sleep(PingInterval)
+				pingAllGRPC()
+			}
+		}()
+	})
+}
+
+func pingAllGRPC() {
+	grpcConnections.Lock()
+	conns := append([]*grpcRemote(nil), grpcConnections.c...)
+	grpcConnections.Unlock()
+
+	for _, r := range conns {
+		state := r.conn.GetState()
+		r.setHealthy(state != connectivity.TransientFailure && state != connectivity.Shutdown)
+	}
+}
+
+// pruneGRPCLRULocked is pruneLRULocked's counterpart for grpcConnections.
+// The caller must hold grpcConnections.Mutex.
+func pruneGRPCLRULocked() {
+	for len(grpcConnections.c) > maxConnections {
+		oldest := 0
+		oldestUsed := grpcConnections.c[0].getLastUsed()
+		for i, r := range grpcConnections.c {
+			if i == 0 {
+				continue
+			}
+			if used := r.getLastUsed(); used.Before(oldestUsed) {
+				oldest, oldestUsed = i, used
+			}
+		}
+		victim := grpcConnections.c[oldest]
+		victim.conn.Close()
+		victim.setEvicted()
+
+		grpcConnections.c = append(grpcConnections.c[:oldest], grpcConnections.c[oldest+1:]...)
+	}
+}
+
+// evictGRPCUserLocked closes and removes every cached grpcConnections entry
+// for name, the grpcConnections counterpart of the sweep EvictUser performs
+// over connections.c. The caller must hold grpcConnections.Mutex.
+func evictGRPCUserLocked(name upspin.UserName) {
+	kept := grpcConnections.c[:0]
+	for _, r := range grpcConnections.c {
+		if r.userName == name {
+			r.conn.Close()
+			r.setEvicted()
+			continue
+		}
+		kept = append(kept, r)
+	}
+	grpcConnections.c = kept
+}
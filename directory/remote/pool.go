@@ -0,0 +1,213 @@
+// Copyright 2016 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package remote
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"upspin.googlesource.com/upspin.git/upspin"
+)
+
+// PingInterval is how often the pool health-checks every cached connection:
+// a net/rpc connection by calling its Server_%d.Ping method, a gRPC
+// connection by sampling its connectivity state. It may be changed before
+// the first Dial to tune
+// how quickly a dead DirServer is noticed.
+var PingInterval = 30 * time.Second
+
+// pingTimeout bounds how long a single health check may take before the
+// connection is declared unhealthy.
+const pingTimeout = 5 * time.Second
+
+// maxConnections bounds the size of the connection cache; once exceeded, the
+// least recently used connection is closed and evicted to make room for a
+// new one, preventing unbounded growth from a client that talks to many
+// short-lived DirServers.
+const maxConnections = 256
+
+// rttBucket boundaries, in ascending order, used by EndpointStats' histogram.
+var rttBucketBounds = [...]time.Duration{
+	time.Millisecond,
+	10 * time.Millisecond,
+	100 * time.Millisecond,
+	time.Second,
+}
+
+// RTTHistogram counts round trips falling into each bucket bounded by
+// rttBucketBounds, plus an overflow bucket for anything slower than the
+// last bound.
+type RTTHistogram struct {
+	Buckets [len(rttBucketBounds) + 1]uint64
+}
+
+func (h *RTTHistogram) observe(d time.Duration) {
+	for i, bound := range rttBucketBounds {
+		if d < bound {
+			h.Buckets[i]++
+			return
+		}
+	}
+	h.Buckets[len(rttBucketBounds)]++
+}
+
+// EndpointStats summarizes activity for one endpoint's connection(s).
+type EndpointStats struct {
+	Calls      uint64
+	Errors     uint64
+	Reconnects uint64
+	RTT        RTTHistogram
+}
+
+var statsMu sync.Mutex
+var statsByAddr = make(map[upspin.NetAddr]*EndpointStats)
+
+func statsFor(addr upspin.NetAddr) *EndpointStats {
+	s, ok := statsByAddr[addr]
+	if !ok {
+		s = &EndpointStats{}
+		statsByAddr[addr] = s
+	}
+	return s
+}
+
+// recordCall records the outcome and latency of one RPC against addr.
+func recordCall(addr upspin.NetAddr, err error, rtt time.Duration) {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	s := statsFor(addr)
+	s.Calls++
+	if err != nil {
+		s.Errors++
+	}
+	s.RTT.observe(rtt)
+}
+
+// recordReconnect records that addr's connection was redialed.
+func recordReconnect(addr upspin.NetAddr) {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	statsFor(addr).Reconnects++
+}
+
+// Stats returns a snapshot of the counters gathered for every endpoint this
+// process has dialed, keyed by NetAddr, for monitoring.
+func Stats() map[upspin.NetAddr]EndpointStats {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	out := make(map[upspin.NetAddr]EndpointStats, len(statsByAddr))
+	for addr, s := range statsByAddr {
+		out[addr] = *s
+	}
+	return out
+}
+
+var pingerOnce sync.Once
+
+// startPinger launches the background health checker exactly once per
+// process. It runs for the lifetime of the process, periodically pinging
+// every cached connection on the gRPC Health Checking Protocol model: a
+// cheap RPC that must succeed within pingTimeout or the connection is
+// marked unhealthy so the next call redials it.
+func startPinger() {
+	pingerOnce.Do(func() {
+		go func() {
+			for {
+				time.Sleep(PingInterval)
+				pingAll()
+			}
+		}()
+	})
+}
+
+func pingAll() {
+	connections.Lock()
+	conns := append([]*remote(nil), connections.c...)
+	connections.Unlock()
+
+	for _, r := range conns {
+		go pingOne(r)
+	}
+}
+
+// pingOne health-checks a single connection, marking it unhealthy if the
+// ping errors or does not complete within pingTimeout. It does not redial:
+// redialing happens lazily, the next time call() notices the connection is
+// unhealthy.
+func pingOne(r *remote) {
+	r.rpcMu.RLock()
+	client := r.rpcClient
+	r.rpcMu.RUnlock()
+	if client == nil {
+		return
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- client.Call(fmt.Sprintf("Server_%d.Ping", r.id), &struct{}{}, &struct{}{})
+	}()
+
+	select {
+	case err := <-done:
+		r.setHealthy(err == nil)
+	case <-time.After(pingTimeout):
+		r.setHealthy(false)
+	}
+}
+
+// EvictUser closes and removes every cached connection for name, on both
+// the net/rpc and gRPC transports, forcing the next Dial for that user to
+// authenticate from scratch. It is called when a user is removed from the
+// system so a lingering session cannot be reused.
+func EvictUser(name upspin.UserName) {
+	connections.Lock()
+	kept := connections.c[:0]
+	for _, r := range connections.c {
+		if r.userName == name {
+			r.rpcMu.Lock()
+			if r.rpcClient != nil {
+				r.rpcClient.Close()
+			}
+			r.rpcMu.Unlock()
+			r.setEvicted()
+			continue
+		}
+		kept = append(kept, r)
+	}
+	connections.c = kept
+	connections.Unlock()
+
+	grpcConnections.Lock()
+	evictGRPCUserLocked(name)
+	grpcConnections.Unlock()
+}
+
+// pruneLRULocked closes and removes the least recently used connections
+// until connections.c is within maxConnections. The caller must hold
+// connections.Mutex.
+func pruneLRULocked() {
+	for len(connections.c) > maxConnections {
+		oldest := 0
+		oldestUsed := connections.c[0].getLastUsed()
+		for i, r := range connections.c {
+			if i == 0 {
+				continue
+			}
+			if used := r.getLastUsed(); used.Before(oldestUsed) {
+				oldest, oldestUsed = i, used
+			}
+		}
+		victim := connections.c[oldest]
+		victim.rpcMu.Lock()
+		if victim.rpcClient != nil {
+			victim.rpcClient.Close()
+		}
+		victim.rpcMu.Unlock()
+		victim.setEvicted()
+
+		connections.c = append(connections.c[:oldest], connections.c[oldest+1:]...)
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright 2016 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package remote
+
+import (
+	"testing"
+	"time"
+
+	"upspin.googlesource.com/upspin.git/upspin"
+)
+
+// withCleanConnections runs f with connections.c empty, restoring whatever
+// was there before on return so this test cannot leak state into others.
+func withCleanConnections(t *testing.T, f func()) {
+	connections.Lock()
+	saved := connections.c
+	connections.c = nil
+	connections.Unlock()
+
+	defer func() {
+		connections.Lock()
+		connections.c = saved
+		connections.Unlock()
+	}()
+	f()
+}
+
+func TestEvictUserMarksConnectionEvicted(t *testing.T) {
+	withCleanConnections(t, func() {
+		evicted := &remote{userName: "evicted@example.com", healthy: true}
+		kept := &remote{userName: "kept@example.com", healthy: true}
+		connections.Lock()
+		connections.c = []*remote{evicted, kept}
+		connections.Unlock()
+
+		EvictUser("evicted@example.com")
+
+		if !evicted.isEvicted() {
+			t.Fatal("EvictUser did not mark the evicted user's connection evicted")
+		}
+		if evicted.isHealthy() {
+			t.Fatal("EvictUser left the evicted connection marked healthy")
+		}
+		if kept.isEvicted() {
+			t.Fatal("EvictUser evicted a connection belonging to a different user")
+		}
+
+		connections.Lock()
+		n := len(connections.c)
+		connections.Unlock()
+		if n != 1 {
+			t.Fatalf("connections.c has %d entries after EvictUser, want 1", n)
+		}
+	})
+}
+
+func TestEvictedConnectionRefusesRedial(t *testing.T) {
+	r := &remote{healthy: true}
+	r.setEvicted()
+
+	if err := r.redial(); err != errEvicted {
+		t.Fatalf("redial on an evicted connection returned %v, want errEvicted", err)
+	}
+}
+
+func TestPruneLRULockedEvictsOldest(t *testing.T) {
+	withCleanConnections(t, func() {
+		now := time.Now()
+
+		// pruneLRULocked only acts once connections.c exceeds
+		// maxConnections, so fill it one over the bound: one
+		// deliberately stale entry plus maxConnections fresh ones.
+		oldest := &remote{endpoint: upspin.Endpoint{NetAddr: "stale"}, healthy: true, lastUsed: now.Add(-time.Hour)}
+		conns := []*remote{oldest}
+		for i := 0; i < maxConnections; i++ {
+			conns = append(conns, &remote{
+				endpoint: upspin.Endpoint{NetAddr: upspin.NetAddr(string(rune('a' + i%26)))},
+				healthy:  true,
+				lastUsed: now,
+			})
+		}
+
+		connections.Lock()
+		connections.c = conns
+		connections.Unlock()
+
+		connections.Lock()
+		pruneLRULocked()
+		n := len(connections.c)
+		connections.Unlock()
+
+		if n != maxConnections {
+			t.Fatalf("connections.c has %d entries after pruneLRULocked, want %d", n, maxConnections)
+		}
+		if !oldest.isEvicted() {
+			t.Fatal("pruneLRULocked did not evict the least recently used connection")
+		}
+		for _, r := range conns[1:] {
+			if r.isEvicted() {
+				t.Fatal("pruneLRULocked evicted a connection that was not the least recently used")
+			}
+		}
+	})
+}
@@ -5,9 +5,10 @@ package remote
 import (
 	"errors"
 	"fmt"
+	"io"
 	"net/rpc"
-	"strings"
 	"sync"
+	"time"
 
 	"upspin.googlesource.com/upspin.git/bind"
 	"upspin.googlesource.com/upspin.git/directory/proto"
@@ -17,13 +18,39 @@ import (
 // remote implements upspin.Directory.
 type remote struct {
 	upspin.NoConfiguration
-	endpoint  upspin.Endpoint
-	userName  upspin.UserName
-	id        int
+	endpoint upspin.Endpoint
+	userName upspin.UserName
+	context  *upspin.Context
+	id       int
+	session  session
+
+	// rpcMu guards rpcClient, which is swapped out by redial when the
+	// health checker or a failed call finds the underlying connection
+	// dead. Readers take rpcMu.RLock only to load rpcClient and release it
+	// before issuing the RPC, so a concurrent redial may close the client
+	// under an in-flight call; that call then fails with rpc.ErrShutdown,
+	// which call treats as a connection error and retries once.
+	rpcMu     sync.RWMutex
 	rpcClient *rpc.Client
+
+	// stateMu guards healthy, lastUsed and evicted, which the pool's
+	// pinger and LRU evictor read and write from outside of any in-flight
+	// call.
+	stateMu  sync.Mutex
+	healthy  bool
+	lastUsed time.Time
+
+	// evicted is set by pruneLRULocked or EvictUser once they have
+	// closed r's client and removed r from connections.c. It stops
+	// redial from silently reviving a connection the pool has torn down
+	// on purpose: a caller still holding r (the normal case, since Dial
+	// hands the pointer straight to upper layers) gets an error instead,
+	// and must Dial again to get a connection the pool tracks.
+	evicted bool
 }
 
-// connections contains a list of all extant connections.
+// connections contains a list of all extant connections, evicted and health
+// checked by the logic in pool.go.
 var connections struct {
 	sync.Mutex
 	c []*remote
@@ -31,9 +58,172 @@ var connections struct {
 
 var _ upspin.Directory = (*remote)(nil)
 
-// call calls the RPC method for the user associated with the remote.
+// errSessionExpired is returned by the server when the caller's session
+// token has expired or is unrecognized; call() reauthenticates and retries
+// once when it sees this error.
+const errSessionExpired = "remote: session expired"
+
+// errEvicted is returned by redial when r has been torn down by
+// pruneLRULocked or EvictUser; the caller must Dial again to obtain a
+// connection the pool tracks, rather than have this one quietly come back
+// to life untracked.
+var errEvicted = errors.New("remote: connection evicted from pool, dial again")
+
+// call calls the RPC method for the user associated with the remote,
+// reauthenticating first if the cached session token is stale or missing.
+// If the underlying connection has been torn down, either because the
+// health checker marked it unhealthy or because this call failed outright,
+// call transparently redials and retries once before giving up.
 func (r *remote) call(method string, req, resp interface{}) error {
-	return r.rpcClient.Call(fmt.Sprintf("Server_%d.%s", r.id, method), req, resp)
+	r.touch()
+	if !r.isHealthy() {
+		if err := r.redial(); err != nil {
+			return err
+		}
+	}
+	if err := r.reauthenticate(r.context); err != nil {
+		return err
+	}
+
+	err := r.doCall(method, req, resp)
+	if err != nil && isConnError(err) {
+		if rerr := r.redial(); rerr == nil {
+			if aerr := r.reauthenticate(r.context); aerr == nil {
+				err = r.doCall(method, req, resp)
+			}
+		}
+	}
+	if err != nil && err.Error() == errSessionExpired {
+		r.session.set("", time.Time{})
+		if aerr := r.reauthenticate(r.context); aerr != nil {
+			return aerr
+		}
+		err = r.doCall(method, req, resp)
+	}
+	return err
+}
+
+// doCall issues a single RPC and records it for Stats, without any
+// reauthentication or redial logic. It attaches the current session token
+// to req immediately before the call, rather than when req was built: call
+// may invoke doCall a second time after reauthenticate has refreshed the
+// token, and the retry must carry that fresh token, not the one (possibly
+// empty) that was current when the caller constructed req.
+func (r *remote) doCall(method string, req, resp interface{}) error {
+	r.rpcMu.RLock()
+	client := r.rpcClient
+	r.rpcMu.RUnlock()
+
+	token, _ := r.session.get()
+	setRequestToken(req, token)
+
+	start := time.Now()
+	err := client.Call(fmt.Sprintf("Server_%d.%s", r.id, method), req, resp)
+	recordCall(r.endpoint.NetAddr, err, time.Since(start))
+	if err != nil && isConnError(err) {
+		r.setHealthy(false)
+	}
+	return err
+}
+
+// setRequestToken attaches token to req so the server can authorize the
+// call itself rather than trust the bare numeric Server_%d id, the same
+// protection WatchRequest.Token already gives the Watch RPC. A type switch
+// over the fixed, small set of Server_%d.* request types is used instead of
+// an interface the proto messages would implement, since directory/proto's
+// generated types carry no methods of their own.
+func setRequestToken(req interface{}, token string) {
+	switch req := req.(type) {
+	case *proto.GlobRequest:
+		req.Token = token
+	case *proto.MakeDirectoryRequest:
+		req.Token = token
+	case *proto.PutRequest:
+		req.Token = token
+	case *proto.WhichAccessRequest:
+		req.Token = token
+	case *proto.DeleteRequest:
+		req.Token = token
+	case *proto.LookupRequest:
+		req.Token = token
+	}
+}
+
+// isConnError reports whether err indicates the underlying connection, not
+// the call itself, failed and is worth redialing for.
+func isConnError(err error) bool {
+	return err == rpc.ErrShutdown || err == io.ErrUnexpectedEOF || err == io.EOF
+}
+
+func (r *remote) touch() {
+	r.stateMu.Lock()
+	r.lastUsed = time.Now()
+	r.stateMu.Unlock()
+}
+
+func (r *remote) isHealthy() bool {
+	r.stateMu.Lock()
+	defer r.stateMu.Unlock()
+	return r.healthy
+}
+
+func (r *remote) setHealthy(healthy bool) {
+	r.stateMu.Lock()
+	r.healthy = healthy
+	r.stateMu.Unlock()
+}
+
+func (r *remote) getLastUsed() time.Time {
+	r.stateMu.Lock()
+	defer r.stateMu.Unlock()
+	return r.lastUsed
+}
+
+func (r *remote) isEvicted() bool {
+	r.stateMu.Lock()
+	defer r.stateMu.Unlock()
+	return r.evicted
+}
+
+func (r *remote) setEvicted() {
+	r.stateMu.Lock()
+	r.evicted = true
+	r.healthy = false
+	r.stateMu.Unlock()
+}
+
+// redial tears down r's connection and dials a fresh one to the same
+// endpoint, invalidating the cached session so the next call reauthenticates.
+// It is safe to call concurrently with in-flight calls on r: doCall reads
+// rpcClient under rpcMu.RLock, so redial's Lock never swaps the field out
+// mid-read, and a call still running on the closed client fails with
+// rpc.ErrShutdown, which call retries once on the replacement. If r has been evicted
+// from the pool, it refuses to redial at all: silently reviving an evicted
+// connection would defeat both EvictUser (a removed user's session would
+// come back on its own) and the LRU bound (an evicted-for-space connection
+// would come back untracked, invisible to future health pings and
+// accounting, and never subject to eviction again).
+func (r *remote) redial() error {
+	if r.isEvicted() {
+		return errEvicted
+	}
+
+	r.rpcMu.Lock()
+	defer r.rpcMu.Unlock()
+
+	client, err := dialTransport(r.context, r.endpoint)
+	if err != nil {
+		r.setHealthy(false)
+		return err
+	}
+	if r.rpcClient != nil {
+		r.rpcClient.Close()
+	}
+	r.rpcClient = client
+	r.session.set("", time.Time{})
+	r.setHealthy(true)
+	recordReconnect(r.endpoint.NetAddr)
+	return nil
 }
 
 // Glob implements upspin.Directory.Glob.
@@ -42,7 +232,7 @@ func (r *remote) Glob(pattern string) ([]*upspin.DirEntry, error) {
 		Pattern: pattern,
 	}
 	var resp proto.GlobResponse
-	err := r.call("Glob", &req, &resp)
+	err := r.call("Glob", req, &resp)
 	return resp.Entries, err
 }
 
@@ -52,7 +242,7 @@ func (r *remote) MakeDirectory(directoryName upspin.PathName) (upspin.Location,
 		Name: directoryName,
 	}
 	var resp proto.MakeDirectoryResponse
-	err := r.call("MakeDirectory", &req, &resp)
+	err := r.call("MakeDirectory", req, &resp)
 	return resp.Location, err
 }
 
@@ -63,7 +253,7 @@ func (r *remote) Put(entry *upspin.DirEntry) error {
 		Entry: entry,
 	}
 	var resp proto.PutResponse
-	return r.call("Put", &req, &resp)
+	return r.call("Put", req, &resp)
 }
 
 // WhichAccess implements upspin.Directory.WhichAccess.
@@ -72,7 +262,7 @@ func (r *remote) WhichAccess(pathName upspin.PathName) (upspin.PathName, error)
 		Name: pathName,
 	}
 	var resp proto.WhichAccessResponse
-	err := r.call("WhichAccess", &req, &resp)
+	err := r.call("WhichAccess", req, &resp)
 	return resp.Name, err
 }
 
@@ -82,7 +272,7 @@ func (r *remote) Delete(pathName upspin.PathName) error {
 		Name: pathName,
 	}
 	var resp proto.DeleteResponse
-	return r.call("Delete", &req, &resp)
+	return r.call("Delete", req, &resp)
 }
 
 // Lookup implements upspin.Directory.Lookup.
@@ -91,21 +281,10 @@ func (r *remote) Lookup(pathName upspin.PathName) (*upspin.DirEntry, error) {
 		Name: pathName,
 	}
 	var resp proto.LookupResponse
-	err := r.call("Lookup", &req, &resp)
+	err := r.call("Lookup", req, &resp)
 	return resp.Entry, err
 }
 
-// Authenticate tells the server which user this is.
-// TODO: Do something cryptographic.
-func (r *remote) Authenticate(userName upspin.UserName) (int, error) {
-	req := &proto.AuthenticateRequest{
-		UserName: userName,
-	}
-	var resp proto.AuthenticateResponse
-	err := r.rpcClient.Call("Server.Authenticate", &req, &resp)
-	return resp.ID, err
-}
-
 // ServerUserName implements upspin.Service.
 func (r *remote) ServerUserName() string {
 	return "" // No one is authenticated.
@@ -119,6 +298,17 @@ func (*remote) Dial(context *upspin.Context, endpoint upspin.Endpoint) (upspin.S
 		return nil, errors.New("remote: unrecognized transport")
 	}
 
+	// The grpc:// scheme speaks an incompatible wire format from net/rpc,
+	// so it gets its own Directory implementation rather than a
+	// TransportDialer.
+	if schemeOf(endpoint.NetAddr) == "grpc" {
+		d, err := dialGRPC(context, stripScheme(endpoint))
+		if err != nil {
+			return nil, err
+		}
+		return d.(upspin.Service), nil
+	}
+
 	// If we already have an authenticated dial for the endpoint and user
 	// return it.
 	connections.Lock()
@@ -133,27 +323,26 @@ func (*remote) Dial(context *upspin.Context, endpoint upspin.Endpoint) (upspin.S
 	r := &remote{
 		endpoint: endpoint,
 		userName: context.UserName,
+		context:  context,
+		healthy:  true,
+		lastUsed: time.Now(),
 	}
 
 	var err error
-	addr := string(endpoint.NetAddr)
-	switch {
-	case strings.HasPrefix(addr, "http://"):
-		r.rpcClient, err = rpc.DialHTTP("tcp", addr[7:])
-	default:
-		err = fmt.Errorf("unrecognized net address in remote: %q", addr)
-	}
+	r.rpcClient, err = dialTransport(context, endpoint)
 	if err != nil {
 		return nil, err
 	}
-	r.id, err = r.Authenticate(context.UserName)
+	r.id, err = r.Authenticate(context)
 	if err != nil {
 		return nil, err
 	}
 
 	connections.Lock()
 	connections.c = append(connections.c, r)
+	pruneLRULocked()
 	connections.Unlock()
+	startPinger()
 	return r, nil
 }
 
@@ -0,0 +1,204 @@
+// Copyright 2016 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package remote
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/rpc"
+	"net/url"
+	"strings"
+	"sync"
+
+	"upspin.googlesource.com/upspin.git/upspin"
+)
+
+// TransportDialer dials the DirServer identified by endpoint and returns a
+// net/rpc client connected to it. context carries the caller's
+// identity and any transport-specific configuration, such as a pinned CA.
+type TransportDialer interface {
+	Dial(context *upspin.Context, endpoint upspin.Endpoint) (*rpc.Client, error)
+}
+
+// transportFunc adapts a plain function to TransportDialer.
+type transportFunc func(context *upspin.Context, endpoint upspin.Endpoint) (*rpc.Client, error)
+
+func (f transportFunc) Dial(context *upspin.Context, endpoint upspin.Endpoint) (*rpc.Client, error) {
+	return f(context, endpoint)
+}
+
+// transports is the registry of TransportDialers, keyed by URL scheme.
+var transports struct {
+	sync.RWMutex
+	m map[string]TransportDialer
+}
+
+// RegisterTransport registers a TransportDialer for the given URL scheme,
+// such as "quic". A dialer registered for "grpc" is never used, since Dial
+// handles grpc:// endpoints itself. It is typically called from the init function
+// of a package that implements a new transport. Registering a scheme that
+// is already registered replaces the previous dialer, mirroring the
+// registration pattern used by go-git's transport/client package.
+func RegisterTransport(scheme string, dialer TransportDialer) {
+	transports.Lock()
+	defer transports.Unlock()
+	if transports.m == nil {
+		transports.m = make(map[string]TransportDialer)
+	}
+	transports.m[scheme] = dialer
+}
+
+// dialTransport parses endpoint.NetAddr as a URL, looks up the TransportDialer
+// registered for its scheme, and dials it. A bare "host:port" address with no
+// scheme is treated as "http" for backwards compatibility with existing
+// deployments.
+func dialTransport(context *upspin.Context, endpoint upspin.Endpoint) (*rpc.Client, error) {
+	scheme := schemeOf(endpoint.NetAddr)
+	transports.RLock()
+	dialer, ok := transports.m[scheme]
+	transports.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("remote: no transport registered for scheme %q in %q", scheme, endpoint.NetAddr)
+	}
+	return dialer.Dial(context, stripScheme(endpoint))
+}
+
+// parseAddr splits an endpoint's NetAddr into a URL scheme and host:port,
+// treating a bare "host:port" with no scheme as "http" for backwards
+// compatibility with deployments that predate the transport registry. A
+// bare address is detected by the absence of a "://" separator rather than
+// by url.Parse's error return: url.Parse happily parses "host:port" as a
+// URL whose Scheme is the hostname (e.g. "localhost:8080" parses with
+// Scheme "localhost"), so trusting its success would silently misroute any
+// hostname-based bare address instead of defaulting it to http.
+func parseAddr(addr upspin.NetAddr) *url.URL {
+	s := string(addr)
+	if !strings.Contains(s, "://") {
+		return &url.URL{Scheme: "http", Host: s}
+	}
+	u, err := url.Parse(s)
+	if err != nil || u.Scheme == "" {
+		return &url.URL{Scheme: "http", Host: s}
+	}
+	return u
+}
+
+// schemeOf returns the URL scheme of an endpoint's NetAddr, defaulting to
+// "http" when none is present.
+func schemeOf(addr upspin.NetAddr) string {
+	return parseAddr(addr).Scheme
+}
+
+// stripScheme returns endpoint with its NetAddr reduced to a bare host:port
+// (for a unix:// address, the socket path), the form TransportDialers and
+// the gRPC dialer expect.
+func stripScheme(endpoint upspin.Endpoint) upspin.Endpoint {
+	u := parseAddr(endpoint.NetAddr)
+	addr := u.Host
+	if u.Scheme == "unix" {
+		addr = u.Host + u.Path
+	}
+	return upspin.Endpoint{Transport: endpoint.Transport, NetAddr: upspin.NetAddr(addr)}
+}
+
+func init() {
+	RegisterTransport("http", transportFunc(dialHTTP))
+	RegisterTransport("https", transportFunc(dialHTTPS))
+	RegisterTransport("unix", transportFunc(dialUnix))
+}
+
+// dialHTTP dials a plaintext net/rpc-over-HTTP DirServer, the long-standing
+// default transport.
+func dialHTTP(context *upspin.Context, endpoint upspin.Endpoint) (*rpc.Client, error) {
+	return rpc.DialHTTP("tcp", string(endpoint.NetAddr))
+}
+
+// dialHTTPS dials a net/rpc-over-HTTP DirServer over TLS, using the system
+// cert pool plus, if context configures one, a pinned CA certificate. The
+// server still expects the same CONNECT preamble that rpc.DialHTTP performs
+// over plaintext (it is served by the same rpc.HandleHTTP handler on
+// rpc.DefaultRPCPath), so this replicates that handshake by hand over the
+// TLS connection rather than handing the raw conn straight to rpc.NewClient.
+func dialHTTPS(context *upspin.Context, endpoint upspin.Endpoint) (*rpc.Client, error) {
+	pool, err := x509.SystemCertPool()
+	if err != nil || pool == nil {
+		pool = x509.NewCertPool()
+	}
+	if ca := context.CertPool; len(ca) > 0 {
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("remote: could not parse pinned CA for %q", endpoint.NetAddr)
+		}
+	}
+	conn, err := tls.Dial("tcp", string(endpoint.NetAddr), &tls.Config{RootCAs: pool})
+	if err != nil {
+		return nil, err
+	}
+	if err := connectRPCOverHTTP(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return rpc.NewClient(conn), nil
+}
+
+// connectRPCOverHTTP performs the HTTP CONNECT handshake net/rpc's
+// DialHTTPPath does before handing a connection to rpc.NewClient: it asks
+// the server to upgrade conn to a raw RPC stream on rpc.DefaultRPCPath and
+// waits for the "200 Connected to Go RPC" response that confirms it did.
+func connectRPCOverHTTP(conn io.ReadWriter) error {
+	io.WriteString(conn, "CONNECT "+rpc.DefaultRPCPath+" HTTP/1.0\n\n")
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "CONNECT"})
+	if err != nil {
+		return err
+	}
+	if resp.Status != "200 Connected to Go RPC" {
+		return fmt.Errorf("remote: unexpected response dialing https rpc: %v", resp.Status)
+	}
+	return nil
+}
+
+// dialUnix dials a DirServer listening on a local unix domain socket,
+// typically one colocated in the same pod or host as the client.
+func dialUnix(context *upspin.Context, endpoint upspin.Endpoint) (*rpc.Client, error) {
+	conn, err := net.Dial("unix", string(endpoint.NetAddr))
+	if err != nil {
+		return nil, err
+	}
+	return rpc.NewClient(conn), nil
+}
+
+// dialRawConn dials endpoint's scheme the same way dialTransport's
+// TransportDialers do, but returns the raw, transport-secured connection
+// instead of wrapping it in an rpc.Client. It exists for callers like the
+// Watch stream that need a long-lived framed connection of their own rather
+// than a request/response RPC client, while still going through the scheme
+// resolution (and, for https, the TLS configuration) the transport registry
+// provides rather than a bare net.Dial.
+func dialRawConn(context *upspin.Context, endpoint upspin.Endpoint) (net.Conn, error) {
+	scheme := schemeOf(endpoint.NetAddr)
+	addr := string(stripScheme(endpoint).NetAddr)
+	switch scheme {
+	case "https", "grpc":
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if ca := context.CertPool; len(ca) > 0 {
+			pool.AppendCertsFromPEM(ca)
+		}
+		return tls.Dial("tcp", addr, &tls.Config{RootCAs: pool})
+	case "unix":
+		return net.Dial("unix", addr)
+	case "http":
+		return net.Dial("tcp", addr)
+	default:
+		return nil, fmt.Errorf("remote: no raw transport for scheme %q in %q", scheme, endpoint.NetAddr)
+	}
+}
@@ -0,0 +1,32 @@
+// Copyright 2016 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package remote
+
+import (
+	"testing"
+
+	"upspin.googlesource.com/upspin.git/upspin"
+)
+
+func TestSchemeOfBareHostPort(t *testing.T) {
+	cases := []struct {
+		addr       string
+		wantScheme string
+	}{
+		{"localhost:8080", "http"},
+		{"example.com:9999", "http"},
+		{"10.0.0.1:8080", "http"},
+		{"http://localhost:8080", "http"},
+		{"https://example.com:443", "https"},
+		{"unix:///tmp/dirserver.sock", "unix"},
+		{"grpc://example.com:9000", "grpc"},
+	}
+	for _, c := range cases {
+		u := parseAddr(upspin.NetAddr(c.addr))
+		if u.Scheme != c.wantScheme {
+			t.Errorf("parseAddr(%q).Scheme = %q, want %q", c.addr, u.Scheme, c.wantScheme)
+		}
+	}
+}
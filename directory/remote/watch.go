@@ -0,0 +1,307 @@
+// Copyright 2016 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package remote
+
+import (
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"upspin.googlesource.com/upspin.git/directory/proto"
+	"upspin.googlesource.com/upspin.git/upspin"
+)
+
+// ErrOutOfRange is the WatchEvent.Err value sent as the final event on a
+// Watch channel when the caller's requested sequence number has already
+// been truncated from the server's mutation log. The caller must re-sync
+// with Glob and call Watch again with a fresh sequence.
+var ErrOutOfRange = errors.New("remote: requested sequence is out of range")
+
+// errWatchGaveUp is the WatchEvent.Err value sent when the stream could not
+// be reestablished after watchMaxConsecutiveFailures attempts.
+var errWatchGaveUp = errors.New("remote: watch stream could not be reestablished")
+
+// WatchEvent is the value delivered on a channel returned by Watch. Exactly
+// one of Event or Err is meaningful on any given value: Err is non-nil only
+// on the last value sent before the channel closes, distinguishing why the
+// watch ended — ErrOutOfRange means the caller must re-sync with Glob and
+// call Watch again with a fresh sequence; any other error means the stream
+// could not be kept alive despite repeated reconnect attempts. Watch offers
+// no way for the caller to cancel: the channel closes only after such a
+// terminal WatchEvent, and a consumer that stops receiving leaves the
+// reading goroutine blocked on its next send.
+type WatchEvent struct {
+	Event *upspin.Event
+	Err   error
+}
+
+// watchHeartbeat is how often the server is expected to send a heartbeat
+// frame on an idle Watch stream; the client treats a missed heartbeat as a
+// dead connection and reconnects.
+const watchHeartbeat = 30 * time.Second
+
+// watchMaxConsecutiveFailures bounds how many times in a row watchLoop will
+// try to reestablish a dropped stream before giving up and reporting
+// errWatchGaveUp, so a permanently unreachable server does not spin
+// forever.
+const watchMaxConsecutiveFailures = 8
+
+const (
+	watchReconnectMinDelay = time.Second
+	watchReconnectMaxDelay = 30 * time.Second
+)
+
+// watchStreamRequest is the net/rpc request for Server_%d.Watch. Unlike the
+// other Server_%d methods, which are simple request/response calls, Watch's
+// response is an address the client dials separately to read the event
+// stream, since net/rpc itself has no notion of a server-streaming call.
+type watchStreamRequest struct {
+	Root     upspin.PathName
+	Sequence int64
+}
+
+// watchStreamResponse carries the address of the stream the client should
+// dial to receive framed WatchEvents for this Watch call, plus a one-time
+// StreamToken the client must present as the first frame on that
+// connection to bind it to the session authenticated on this rpcClient.
+type watchStreamResponse struct {
+	StreamAddr  string
+	StreamToken string
+}
+
+// watchHandshake is the first gob value the client writes on a freshly
+// dialed watch stream connection, authenticating that connection as a
+// continuation of the already-authenticated Watch RPC rather than an
+// anonymous socket.
+type watchHandshake struct {
+	StreamToken string
+}
+
+// watchFrame is one gob-encoded unit read from a watch stream connection
+// after the handshake.
+type watchFrame struct {
+	Sequence   int64
+	Entry      *upspin.DirEntry
+	Deleted    bool
+	Heartbeat  bool
+	OutOfRange bool
+}
+
+// Watch implements upspin.Directory.Watch for the net/rpc transport. It asks
+// the server for a stream address and token, dials it through the same
+// scheme resolution dialTransport uses, and decodes framed events in a
+// background goroutine that transparently reconnects — through the
+// transport registry, reauthenticating as needed — when the connection
+// dies.
+func (r *remote) Watch(root upspin.PathName, sequence int64) (<-chan WatchEvent, error) {
+	conn, err := r.dialWatchStream(root, sequence)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(chan WatchEvent)
+	go r.watchLoop(root, sequence, conn, out)
+	return out, nil
+}
+
+// dialWatchStream asks the server for a stream address via the ordinary,
+// reauthenticating r.call, dials that address through dialRawConn (so it
+// gets the same TLS/unix handling dialTransport's built-in dialers do
+// rather than a bare net.Dial), and presents the returned StreamToken as a
+// handshake before returning the connection ready to decode watchFrames.
+func (r *remote) dialWatchStream(root upspin.PathName, sequence int64) (net.Conn, error) {
+	var resp watchStreamResponse
+	req := &watchStreamRequest{Root: root, Sequence: sequence}
+	if err := r.call("Watch", req, &resp); err != nil {
+		return nil, err
+	}
+
+	// resp.StreamAddr is a bare host:port; dial it with the same scheme
+	// (and so the same TLS handling) as the connection it was handed back
+	// on, rather than trusting dialRawConn's bare-address default.
+	streamAddr := schemeOf(r.endpoint.NetAddr) + "://" + resp.StreamAddr
+	conn, err := dialRawConn(r.context, upspin.Endpoint{
+		Transport: r.endpoint.Transport,
+		NetAddr:   upspin.NetAddr(streamAddr),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("remote: dialing watch stream: %v", err)
+	}
+	if err := gob.NewEncoder(conn).Encode(&watchHandshake{StreamToken: resp.StreamToken}); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("remote: authenticating watch stream: %v", err)
+	}
+	return conn, nil
+}
+
+// watchLoop reads frames from conn and forwards them to out as WatchEvents,
+// redialing the stream via dialWatchStream whenever the connection dies for
+// any reason other than the server reporting the sequence out of range. It
+// sends a single terminal WatchEvent and closes out when the watch ends for
+// good: on ErrOutOfRange, or after watchMaxConsecutiveFailures reconnect
+// attempts fail in a row.
+func (r *remote) watchLoop(root upspin.PathName, sequence int64, conn net.Conn, out chan<- WatchEvent) {
+	defer close(out)
+
+	failures := 0
+	delay := watchReconnectMinDelay
+	for {
+		lastSeq, outOfRange, err := r.readWatchStream(conn, sequence, out)
+		conn.Close()
+		sequence = lastSeq
+
+		if outOfRange {
+			out <- WatchEvent{Err: ErrOutOfRange}
+			return
+		}
+		if err == nil {
+			// readWatchStream returns a nil error only together
+			// with outOfRange, handled above, so this is not reached.
+			return
+		}
+
+		conn, err = r.dialWatchStream(root, sequence)
+		for err != nil {
+			failures++
+			if failures >= watchMaxConsecutiveFailures {
+				out <- WatchEvent{Err: errWatchGaveUp}
+				return
+			}
+			time.Sleep(delay)
+			if delay *= 2; delay > watchReconnectMaxDelay {
+				delay = watchReconnectMaxDelay
+			}
+			conn, err = r.dialWatchStream(root, sequence)
+		}
+		failures = 0
+		delay = watchReconnectMinDelay
+	}
+}
+
+// readWatchStream decodes watchFrames from conn and forwards mutations to
+// out until the connection closes, a heartbeat is missed, or the server
+// reports the sequence is out of range. It returns the sequence number of
+// the last successfully delivered event (so a reconnect can resume from
+// there), whether the stream ended because of ErrOutOfRange, and the error
+// that ended the read, if any.
+func (r *remote) readWatchStream(conn net.Conn, sequence int64, out chan<- WatchEvent) (lastSeq int64, outOfRange bool, err error) {
+	lastSeq = sequence
+	dec := gob.NewDecoder(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(2 * watchHeartbeat))
+		var frame watchFrame
+		if err := dec.Decode(&frame); err != nil {
+			return lastSeq, false, err
+		}
+		switch {
+		case frame.OutOfRange:
+			return lastSeq, true, nil
+		case frame.Heartbeat:
+			continue
+		default:
+			lastSeq = frame.Sequence
+			out <- WatchEvent{Event: &upspin.Event{
+				Entry:    frame.Entry,
+				Deleted:  frame.Deleted,
+				Sequence: frame.Sequence,
+			}}
+		}
+	}
+}
+
+// Watch implements upspin.Directory.Watch for the gRPC transport, reading
+// from a server-streaming RPC instead of a secondary raw connection, and
+// transparently reestablishing that stream if it drops for any reason other
+// than the server reporting the sequence out of range.
+func (r *grpcRemote) Watch(root upspin.PathName, sequence int64) (<-chan WatchEvent, error) {
+	stream, cancel, err := r.dialWatchStream(root, sequence)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(chan WatchEvent)
+	go r.watchLoop(root, sequence, stream, cancel, out)
+	return out, nil
+}
+
+func (r *grpcRemote) dialWatchStream(root upspin.PathName, sequence int64) (proto.DirService_WatchClient, context.CancelFunc, error) {
+	if err := r.authenticateIfNeeded(); err != nil {
+		return nil, nil, err
+	}
+	token, _ := r.session.get()
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err := r.client.Watch(ctx, &proto.WatchRequest{Root: string(root), Sequence: sequence, Token: token})
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	return stream, cancel, nil
+}
+
+func (r *grpcRemote) watchLoop(root upspin.PathName, sequence int64, stream proto.DirService_WatchClient, cancel context.CancelFunc, out chan<- WatchEvent) {
+	defer close(out)
+
+	failures := 0
+	delay := watchReconnectMinDelay
+	for {
+		lastSeq, outOfRange, err := r.readWatchStream(stream, sequence, out)
+		cancel()
+		sequence = lastSeq
+
+		if outOfRange {
+			out <- WatchEvent{Err: ErrOutOfRange}
+			return
+		}
+		if err == nil {
+			return
+		}
+
+		stream, cancel, err = r.dialWatchStream(root, sequence)
+		for err != nil {
+			failures++
+			if failures >= watchMaxConsecutiveFailures {
+				out <- WatchEvent{Err: errWatchGaveUp}
+				return
+			}
+			time.Sleep(delay)
+			if delay *= 2; delay > watchReconnectMaxDelay {
+				delay = watchReconnectMaxDelay
+			}
+			stream, cancel, err = r.dialWatchStream(root, sequence)
+		}
+		failures = 0
+		delay = watchReconnectMinDelay
+	}
+}
+
+func (r *grpcRemote) readWatchStream(stream proto.DirService_WatchClient, sequence int64, out chan<- WatchEvent) (lastSeq int64, outOfRange bool, err error) {
+	lastSeq = sequence
+	for {
+		ev, err := stream.Recv()
+		if err != nil {
+			return lastSeq, false, err
+		}
+		switch {
+		case ev.OutOfRange:
+			return lastSeq, true, nil
+		case ev.Heartbeat:
+			continue
+		default:
+			entry, err := unmarshalDirEntry(ev.Entry)
+			if err != nil {
+				return lastSeq, false, err
+			}
+			lastSeq = ev.Sequence
+			out <- WatchEvent{Event: &upspin.Event{
+				Entry:    entry,
+				Deleted:  ev.Deleted,
+				Sequence: ev.Sequence,
+			}}
+		}
+	}
+}